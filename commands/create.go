@@ -2,8 +2,6 @@ package commands
 
 import (
 	"bytes"
-	"compress/gzip"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -14,6 +12,7 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/rancher/machine/commands/mcndirs"
@@ -27,9 +26,10 @@ import (
 	"github.com/rancher/machine/libmachine/log"
 	"github.com/rancher/machine/libmachine/mcnerror"
 	"github.com/rancher/machine/libmachine/mcnflag"
+	"github.com/rancher/machine/libmachine/provision"
 	"github.com/rancher/machine/libmachine/swarm"
+	"github.com/rancher/machine/libmachine/userdata"
 	"github.com/urfave/cli"
-	"gopkg.in/yaml.v2"
 )
 
 var (
@@ -128,6 +128,29 @@ var (
 			Name:  "swarm-experimental",
 			Usage: "Enable Swarm experimental features",
 		},
+		cli.BoolFlag{
+			Name:  "swarm-mode",
+			Usage: "Configure Machine with native Docker Swarm-mode",
+		},
+		cli.BoolFlag{
+			Name:  "swarm-mode-manager",
+			Usage: "Configure Machine to be a Swarm-mode manager. Additional managers must be created one at a time (via depends_on when using compose-up), not concurrently: a manager created before the first one has finished initializing cannot discover it and will bootstrap its own separate cluster instead of joining",
+		},
+		cli.StringFlag{
+			Name:  "swarm-mode-join-token",
+			Usage: "Swarm-mode join token to use when joining an existing cluster",
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  "swarm-mode-advertise-addr",
+			Usage: "Address advertised to other members of the Swarm-mode cluster",
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  "swarm-mode-listen-addr",
+			Usage: "Address Swarm-mode listens on for cluster management traffic",
+			Value: "",
+		},
 		cli.StringSliceFlag{
 			Name:  "tls-san",
 			Usage: "Support extra SANs for TLS certs",
@@ -138,6 +161,21 @@ var (
 			Usage: "Use a custom provisioning script instead of installing docker",
 			Value: "",
 		},
+		cli.StringFlag{
+			Name:  "userdata-template-driver",
+			Usage: "Template driver used to render userdata and custom-install-script before merging (golang or none); note {{.IP}} is usually empty since rendering happens before the driver has created the machine and can report one",
+			Value: "none",
+		},
+		cli.StringSliceFlag{
+			Name:  "userdata-template-var",
+			Usage: "Specify key=value pairs to expose to the userdata template",
+			Value: &cli.StringSlice{},
+		},
+		cli.StringFlag{
+			Name:  "userdata-format",
+			Usage: "Userdata format to merge custom-install-script into: auto, shell, cloud-config, ignition, or butane",
+			Value: "auto",
+		},
 	}
 )
 
@@ -210,6 +248,13 @@ func cmdCreateInner(c CommandLine, api libmachine.API) error {
 			ArbitraryFlags:     c.StringSlice("swarm-opt"),
 			ArbitraryJoinFlags: c.StringSlice("swarm-join-opt"),
 			IsExperimental:     c.Bool("swarm-experimental"),
+			Mode: swarm.Mode{
+				Enabled:       c.Bool("swarm-mode"),
+				Manager:       c.Bool("swarm-mode-manager"),
+				JoinToken:     c.String("swarm-mode-join-token"),
+				AdvertiseAddr: c.String("swarm-mode-advertise-addr"),
+				ListenAddr:    c.String("swarm-mode-listen-addr"),
+			},
 		},
 	}
 
@@ -238,7 +283,12 @@ func cmdCreateInner(c CommandLine, api libmachine.API) error {
 		h.HostOptions.SwarmOptions = nil
 
 		if userdataFlag != "" {
-			err = updateUserdataFile(driverOpts, userdataFlag, customInstallScript)
+			tmplOpts, err := buildUserdataTemplateOptions(c, h)
+			if err != nil {
+				return fmt.Errorf("Error building userdata template context: %v", err)
+			}
+
+			err = updateUserdataFile(driverOpts, userdataFlag, customInstallScript, c.String("userdata-format"), tmplOpts)
 			if err != nil {
 				return fmt.Errorf("could not alter cloud-init file: %v", err)
 			}
@@ -268,6 +318,12 @@ func cmdCreateInner(c CommandLine, api libmachine.API) error {
 		}
 	}
 
+	if h.HostOptions.SwarmOptions != nil && h.HostOptions.SwarmOptions.Mode.Enabled {
+		if err := configureSwarmMode(api, h); err != nil {
+			return fmt.Errorf("Error configuring Swarm-mode: %s", err)
+		}
+	}
+
 	if err := api.Save(h); err != nil {
 		return fmt.Errorf("Error attempting to save store: %s", err)
 	}
@@ -457,6 +513,131 @@ func addDriverFlagsToCommand(cliFlags []cli.Flag, cmd *cli.Command) *cli.Command
 	return cmd
 }
 
+// swarmModeAction is what configureSwarmMode should do for a given node,
+// decided purely from its own Mode config and whether an existing manager
+// was discoverable in the machine store. Pulling this selection out of
+// configureSwarmMode means the branching that chunk0-1's join-token and
+// duplicate-init bugs were in can be unit tested without a live
+// libmachine.API/host.Host.
+type swarmModeAction int
+
+const (
+	// swarmModeActionJoinExplicit joins the cluster using the caller's own
+	// mode.JoinToken, regardless of mode.Manager.
+	swarmModeActionJoinExplicit swarmModeAction = iota
+	// swarmModeActionInit bootstraps a new cluster: this is the very first
+	// manager, since no manager is discoverable yet.
+	swarmModeActionInit
+	// swarmModeActionJoinManager joins an already-discovered cluster as an
+	// additional manager.
+	swarmModeActionJoinManager
+	// swarmModeActionJoinWorker joins an already-discovered cluster as a
+	// worker.
+	swarmModeActionJoinWorker
+	// swarmModeActionErrNoManager means mode.Manager is false and no
+	// manager could be discovered to join as a worker.
+	swarmModeActionErrNoManager
+)
+
+func decideSwarmModeAction(mode swarm.Mode, managerDiscovered bool) swarmModeAction {
+	if mode.JoinToken != "" {
+		return swarmModeActionJoinExplicit
+	}
+
+	if mode.Manager {
+		if !managerDiscovered {
+			return swarmModeActionInit
+		}
+		return swarmModeActionJoinManager
+	}
+
+	if !managerDiscovered {
+		return swarmModeActionErrNoManager
+	}
+
+	return swarmModeActionJoinWorker
+}
+
+// configureSwarmMode runs `docker swarm init` on the very first manager of
+// a native Swarm-mode cluster (i.e. when no manager is yet discoverable in
+// the machine store), or otherwise joins the existing cluster: as an
+// additional manager when mode.Manager is set, as a worker otherwise. An
+// explicit mode.JoinToken always wins over an auto-discovered one, since
+// the caller may be joining with a different role's token. The manager
+// address still comes from the machine store, so an explicit token with no
+// discoverable manager returns an error. The resulting tokens are written back onto
+// h.HostOptions.SwarmOptions.Mode so that the subsequent api.Save(h)
+// persists them in the machine store.
+func configureSwarmMode(api libmachine.API, h *host.Host) error {
+	mode := h.HostOptions.SwarmOptions.Mode
+
+	managerAddr, managerToken, workerToken, discoverErr := discoverSwarmModeManager(api)
+
+	switch decideSwarmModeAction(mode, discoverErr == nil) {
+	case swarmModeActionJoinExplicit:
+		if discoverErr != nil {
+			return discoverErr
+		}
+		return provision.SwarmModeJoin(h, managerAddr, mode.JoinToken, mode)
+
+	case swarmModeActionInit:
+		managerTok, workerTok, err := provision.SwarmModeInit(h, mode)
+		if err != nil {
+			return err
+		}
+
+		h.HostOptions.SwarmOptions.Mode.ManagerToken = managerTok
+		h.HostOptions.SwarmOptions.Mode.WorkerToken = workerTok
+
+		return nil
+
+	case swarmModeActionJoinManager:
+		return provision.SwarmModeJoin(h, managerAddr, managerToken, mode)
+
+	case swarmModeActionJoinWorker:
+		return provision.SwarmModeJoin(h, managerAddr, workerToken, mode)
+
+	default: // swarmModeActionErrNoManager
+		return discoverErr
+	}
+}
+
+// discoverSwarmModeManager scans the machine store for an existing
+// Swarm-mode manager to join, returning its driver-reported IP with the
+// Swarm-mode management port 2377 (its AdvertiseAddr is not used) along with
+// both its manager and worker join tokens.
+func discoverSwarmModeManager(api libmachine.API) (addr, managerToken, workerToken string, err error) {
+	names, err := api.List()
+	if err != nil {
+		return "", "", "", fmt.Errorf("Error listing hosts to discover a Swarm-mode manager: %s", err)
+	}
+
+	for _, name := range names {
+		other, err := api.Load(name)
+		if err != nil {
+			continue
+		}
+
+		if other.HostOptions == nil || other.HostOptions.SwarmOptions == nil {
+			continue
+		}
+
+		mode := other.HostOptions.SwarmOptions.Mode
+		if !mode.Enabled || !mode.Manager || mode.ManagerToken == "" {
+			continue
+		}
+
+		ip, err := other.Driver.GetIP()
+		if err != nil {
+			continue
+		}
+
+		return fmt.Sprintf("%s:2377", ip), mode.ManagerToken, mode.WorkerToken, nil
+	}
+
+	return "", "", "", fmt.Errorf("could not discover a Swarm-mode manager to join")
+}
+
 func validateSwarmDiscovery(discovery string) error {
 	if discovery == "" {
 		return nil
@@ -483,31 +664,116 @@ func tlsPath(c CommandLine, flag string, defaultName string) string {
 	return filepath.Join(mcndirs.GetMachineCertDir(), defaultName)
 }
 
-func gzipEncode(data []byte) (string, error) {
-	var b bytes.Buffer
-	gz := gzip.NewWriter(&b)
-	gz.Flush()
-	if _, err := gz.Write(data); err != nil {
-		return "", err
+// userdataTemplateContext is exposed to userdata and custom-install-script
+// templates when --userdata-template-driver=golang is set.
+type userdataTemplateContext struct {
+	MachineName string
+	DriverName  string
+	// IP is the driver-reported IP. It's read before the machine exists,
+	// so for most drivers it's empty; templates that need the IP should
+	// fetch it themselves post-create (e.g. via custom-install-script).
+	IP      string
+	SSHUser string
+	TLSSan  []string
+	Vars    map[string]string
+}
+
+// userdataTemplateOptions bundles the template driver selection together
+// with the context it renders against.
+type userdataTemplateOptions struct {
+	driver  string
+	context userdataTemplateContext
+}
+
+// buildUserdataTemplateOptions reads --userdata-template-driver and
+// --userdata-template-var and assembles the context that templated userdata
+// and custom-install-scripts are rendered against.
+func buildUserdataTemplateOptions(c CommandLine, h *host.Host) (*userdataTemplateOptions, error) {
+	driver := c.String("userdata-template-driver")
+	if driver == "" {
+		driver = "none"
+	}
+	if driver != "golang" && driver != "none" {
+		return nil, fmt.Errorf("unrecognized userdata template driver: %s", driver)
+	}
+
+	vars := map[string]string{}
+	for _, kv := range c.StringSlice("userdata-template-var") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("userdata-template-var must be in the form key=value, got: %s", kv)
+		}
+		vars[parts[0]] = parts[1]
+	}
+
+	ip, err := h.Driver.GetIP()
+	if err != nil {
+		// Many drivers can't report an IP until after create; templates
+		// that don't reference {{.IP}} should still work.
+		ip = ""
+	}
+
+	return &userdataTemplateOptions{
+		driver: driver,
+		context: userdataTemplateContext{
+			MachineName: h.Name,
+			DriverName:  h.DriverName,
+			IP:          ip,
+			SSHUser:     h.Driver.GetSSHUsername(),
+			TLSSan:      c.StringSlice("tls-san"),
+			Vars:        vars,
+		},
+	}, nil
+}
+
+// renderUserdataTemplate renders content as a Go text/template against ctx.
+func renderUserdataTemplate(content []byte, ctx userdataTemplateContext) ([]byte, error) {
+	tmpl, err := template.New("userdata").Parse(string(content))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, ctx); err != nil {
+		return nil, err
 	}
-	if err := gz.Close(); err != nil {
-		return "", err
+
+	return buf.Bytes(), nil
+}
+
+// defaultUserdataContent returns an empty starting document for
+// userdataFormat, matched to whichever userdata.Formatter will end up
+// parsing it in updateUserdataFile.
+func defaultUserdataContent(userdataFormat string) []byte {
+	switch userdataFormat {
+	case "ignition":
+		return []byte("{}")
+	case "butane":
+		return []byte("variant: fcos\nversion: 1.5.0\n")
+	case "shell":
+		return []byte("#!/bin/sh\n")
+	default:
+		// "", "auto" and "cloud-config" all default to an empty
+		// cloud-config document.
+		return []byte("#cloud-config")
 	}
-	encoded := base64.StdEncoding.EncodeToString([]byte(b.Bytes()))
-	return encoded, nil
 }
 
 // If the user has provided a userdata file, then we add the customInstallScript to their userdata file.
-// This assumes that the user-provided userdata file start with a shebang or `#cloud-config`
+// The userdata format (shell, cloud-config, Ignition or Butane) is auto-detected from its magic prefix
+// unless --userdata-format pins one explicitly.
 // If the user has not provided any userdata file, then we set the customInstallScript as the userdata file.
-func updateUserdataFile(driverOpts *rpcdriver.RPCFlags, userdataFlag, customInstallScript string) error {
+func updateUserdataFile(driverOpts *rpcdriver.RPCFlags, userdataFlag, customInstallScript, userdataFormat string, tmplOpts *userdataTemplateOptions) error {
 	var userdataContent []byte
 	var err error
 	userdataFile := driverOpts.String(userdataFlag)
 
 	if userdataFile == "" {
-		// Always convert to cloud config if user data is not provided
-		userdataContent = []byte("#cloud-config")
+		// Seed an empty starting document for the selected/detected
+		// format so --userdata-format can be paired with
+		// --custom-install-script alone, with no user-supplied userdata
+		// file.
+		userdataContent = defaultUserdataContent(userdataFormat)
 	} else {
 		userdataContent, err = ioutil.ReadFile(userdataFile)
 		if err != nil {
@@ -522,114 +788,53 @@ func updateUserdataFile(driverOpts *rpcdriver.RPCFlags, userdataFlag, customInst
 	// Remove the shebang
 	customScriptContent = regexp.MustCompile(`^#!.*\n`).ReplaceAll(customScriptContent, nil)
 
-	modifiedUserdataFile, err := ioutil.TempFile("", "modified-user-data")
-	if err != nil {
-		return err
-	}
-	defer modifiedUserdataFile.Close()
-
-	if err := replaceUserdataFile(userdataContent, customScriptContent, modifiedUserdataFile); err != nil {
-		return err
-	}
-
-	driverOpts.Values[userdataFlag] = modifiedUserdataFile.Name()
-
-	return nil
-}
-
-func writeCloudConfig(encodedData string, cf map[interface{}]interface{}, newUserDataFile *os.File) error {
+	if tmplOpts != nil && tmplOpts.driver == "golang" {
+		userdataContent, err = renderUserdataTemplate(userdataContent, tmplOpts.context)
+		if err != nil {
+			return fmt.Errorf("error rendering userdata template: %v", err)
+		}
 
-	// Add to the write_files directive
-	writeFile := map[string]string{
-		"encoding":    "gzip+b64",
-		"content":     fmt.Sprintf("%s", encodedData),
-		"path":        "/usr/local/custom_script/install.sh",
-		"permissions": "0644",
-	}
-	if err := addToCloudConfig(cf, "write_files", writeFile); err != nil {
-		return err
+		customScriptContent, err = renderUserdataTemplate(customScriptContent, tmplOpts.context)
+		if err != nil {
+			return fmt.Errorf("error rendering custom-install-script template: %v", err)
+		}
 	}
 
-	// Add to the runmd directive
-	if err := addToCloudConfig(cf, "runcmd", fmt.Sprintf("sh %s", writeFile["path"])); err != nil {
-		return err
+	var formatter userdata.Formatter
+	if userdataFormat == "" || userdataFormat == "auto" {
+		formatter, err = userdata.Detect(userdataContent)
+	} else {
+		formatter, err = userdata.ByName(userdataFormat)
 	}
-
-	userdataContent, err := yaml.Marshal(cf)
 	if err != nil {
 		return err
 	}
 
-	userdataContent = append([]byte("#cloud-config\n"), userdataContent...)
-	_, err = newUserDataFile.Write(userdataContent)
+	merged, err := formatter.Merge(userdataContent, customScriptContent)
 	if err != nil {
 		return err
 	}
 
-	log.Debugf("Modified userdata file contents: %+v", string(userdataContent))
-
-	return nil
-}
-
-// replaceUserdataFile adds the customScriptContent to the user-provided userdata file and creates a new
-// temp file for this content.
-// If the user-provided userdata file starts with a shebang, then we can add it to the customScriptContent and add data to the `runcmd` directive.
-// fi the user-provided userdata file is in cloud-config format, then we add the customScriptContent to the `runcmd` directive.
-func replaceUserdataFile(userdataContent, customScriptContent []byte, newUserDataFile *os.File) error {
-	switch {
-	case bytes.HasPrefix(userdataContent, []byte("#!")):
-		// The user provided a script file, so the customInstallScript contents is appended to user script
-		// and added to the "runcmd" section so modified user data is always in cloud config format.
-
-		// Remove the shebang
-		userdataContent = regexp.MustCompile(`^#!.*\n`).ReplaceAll(userdataContent, nil)
-
-		cf := make(map[interface{}]interface{})
-		encodedData, err := gzipEncode(bytes.Join([][]byte{userdataContent, customScriptContent}, []byte("\n\n")))
-		if err != nil {
-			return err
-		}
-
-		if err := writeCloudConfig(encodedData, cf, newUserDataFile); err != nil {
-			return err
-		}
-
-	case bytes.HasPrefix(userdataContent, []byte("#cloud-config")):
-		// The user provided a cloud-config file, so the customInstallScript context is added to the
-		// "runcmd" section of the YAML.
-		cf := make(map[interface{}]interface{})
-		if err := yaml.Unmarshal(userdataContent, &cf); err != nil {
-			return err
-		}
-
-		encodedCustomInstallScript, err := gzipEncode(customScriptContent)
+	if butaneFormatter, ok := formatter.(*userdata.ButaneFormatter); ok {
+		merged, err = butaneFormatter.Transpile(merged)
 		if err != nil {
 			return err
 		}
-
-		if err := writeCloudConfig(encodedCustomInstallScript, cf, newUserDataFile); err != nil {
-			return err
-		}
-
-	default:
-		return fmt.Errorf("existing userdata file does not begin with '#!' or '#cloud-config'")
 	}
 
-	return nil
-}
+	modifiedUserdataFile, err := ioutil.TempFile("", "modified-user-data")
+	if err != nil {
+		return err
+	}
+	defer modifiedUserdataFile.Close()
 
-func addToCloudConfig(cf map[interface{}]interface{}, key string, value interface{}) error {
-	switch section := cf[key].(type) {
-	case []interface{}:
-		section = append(section, value)
-		cf[key] = section
+	if _, err := modifiedUserdataFile.Write(merged); err != nil {
+		return err
+	}
 
-	case nil:
-		cf[key] = []interface{}{value}
+	log.Debugf("Modified userdata file contents: %+v", string(merged))
 
-	default:
-		return fmt.Errorf("unable to get %s from cloud-config YAML", key)
-	}
+	driverOpts.Values[userdataFlag] = modifiedUserdataFile.Name()
 
 	return nil
 }
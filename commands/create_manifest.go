@@ -0,0 +1,419 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"sync"
+
+	"github.com/rancher/machine/libmachine"
+	"github.com/rancher/machine/libmachine/log"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+)
+
+// manifestConcurrency bounds how many machines cmdCreateFromManifest creates
+// at once within a single depends_on batch.
+const manifestConcurrency = 4
+
+// manifestMachine describes one machine entry in a create manifest.
+//
+// driver_opts, engine_opts and swarm_opts are intentionally typed as
+// map[string]interface{} rather than map[string]string: driver flags like
+// --swarm or --swarm-master aren't strings, and options such as
+// engine-opt/engine-label/engine-env/swarm-opt/swarm-join-opt are
+// StringSliceFlags, so a YAML entry for them needs to be a list
+// (`engine-opt: ["label=foo"]`) rather than a scalar.
+type manifestMachine struct {
+	Name                string                 `yaml:"name"`
+	Driver              string                 `yaml:"driver"`
+	DriverOpts          map[string]interface{} `yaml:"driver_opts"`
+	EngineOpts          map[string]interface{} `yaml:"engine_opts"`
+	SwarmOpts           map[string]interface{} `yaml:"swarm_opts"`
+	TLSSan              []string               `yaml:"tls_sans"`
+	CustomInstallScript string                 `yaml:"custom_install_script"`
+	DependsOn           []string               `yaml:"depends_on"`
+}
+
+// manifest is the top-level shape of a `docker-machine compose-up -f
+// machines.yaml` manifest describing several machines to create together.
+//
+// Note: additional Swarm-mode managers (driver_opts/swarm-mode-manager:
+// true beyond the first) must depends_on an earlier manager rather than
+// share its wave; machines in the same wave are created concurrently via
+// runManifestBatch, and two managers created at the same time can't
+// discover each other, so each bootstraps its own separate cluster.
+type manifest struct {
+	Machines []manifestMachine `yaml:"machines"`
+}
+
+// CreateFromManifestCommand is wired into the top-level commands.Commands
+// slice as `compose-up`.
+var CreateFromManifestCommand = cli.Command{
+	Name:  "compose-up",
+	Usage: "Create multiple machines concurrently from a YAML manifest",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "f",
+			Usage: "Path to a YAML manifest describing the machines to create",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Print the resolved creation plan without creating any machines",
+		},
+		cli.BoolFlag{
+			Name:  "continue-on-error",
+			Usage: "Keep creating remaining machines if one fails instead of stopping on the first error",
+		},
+	},
+	Action: runCommand(cmdCreateFromManifest),
+}
+
+// cmdCreateFromManifest reads a YAML manifest of machines and creates them
+// concurrently, honoring each machine's depends_on ordering. It reuses
+// cmdCreateInner's existing create pipeline by synthesizing a CommandLine
+// per manifest entry rather than shelling out to `docker-machine create`.
+func cmdCreateFromManifest(c CommandLine, api libmachine.API) error {
+	manifestPath := c.String("f")
+	if manifestPath == "" {
+		return fmt.Errorf("Error: no manifest file specified, use -f")
+	}
+
+	raw, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return fmt.Errorf("Error reading manifest %s: %s", manifestPath, err)
+	}
+
+	var m manifest
+	if err := yaml.Unmarshal(raw, &m); err != nil {
+		return fmt.Errorf("Error parsing manifest %s: %s", manifestPath, err)
+	}
+
+	batches, err := resolveManifestOrder(m.Machines)
+	if err != nil {
+		return fmt.Errorf("Error resolving manifest depends_on order: %s", err)
+	}
+
+	if c.Bool("dry-run") {
+		for i, batch := range batches {
+			for _, mm := range batch {
+				log.Infof("[wave %d] would create %q with driver %q (depends_on: %v)", i+1, mm.Name, mm.Driver, mm.DependsOn)
+			}
+		}
+		return nil
+	}
+
+	continueOnError := c.Bool("continue-on-error")
+	var created []string
+	failed := map[string]error{}
+
+	for _, batch := range batches {
+		var runnable []manifestMachine
+		for _, mm := range batch {
+			if dep, ok := failedDependency(mm, failed); ok {
+				failed[mm.Name] = fmt.Errorf("skipped: depends_on %q did not succeed", dep)
+				continue
+			}
+			runnable = append(runnable, mm)
+		}
+
+		for name, err := range runManifestBatch(runnable, api) {
+			if err != nil {
+				failed[name] = err
+				continue
+			}
+			created = append(created, name)
+		}
+
+		if len(failed) > 0 && !continueOnError {
+			break
+		}
+	}
+
+	if len(failed) > 0 {
+		resumePath := manifestPath + ".resume.yaml"
+		if err := writeResumeManifest(resumePath, m.Machines, created); err != nil {
+			log.Errorf("Error writing resume manifest %s: %s", resumePath, err)
+		} else {
+			log.Infof("wrote resume manifest for the remaining machines to %s", resumePath)
+		}
+
+		for name, err := range failed {
+			log.Errorf("failed to create %q: %s", name, err)
+		}
+
+		return fmt.Errorf("failed to create %d of %d machines", len(failed), len(m.Machines))
+	}
+
+	return nil
+}
+
+// resolveManifestOrder splits machines into depends_on-ordered waves: every
+// machine in a wave only depends on machines created in earlier waves.
+func resolveManifestOrder(machines []manifestMachine) ([][]manifestMachine, error) {
+	byName := map[string]manifestMachine{}
+	for _, m := range machines {
+		byName[m.Name] = m
+	}
+
+	done := map[string]bool{}
+	var batches [][]manifestMachine
+
+	for len(done) < len(machines) {
+		var batch []manifestMachine
+		for _, m := range machines {
+			if done[m.Name] {
+				continue
+			}
+
+			ready := true
+			for _, dep := range m.DependsOn {
+				if _, ok := byName[dep]; !ok {
+					return nil, fmt.Errorf("machine %q depends_on unknown machine %q", m.Name, dep)
+				}
+				if !done[dep] {
+					ready = false
+					break
+				}
+			}
+
+			if ready {
+				batch = append(batch, m)
+			}
+		}
+
+		if len(batch) == 0 {
+			return nil, fmt.Errorf("manifest has a depends_on cycle")
+		}
+
+		for _, m := range batch {
+			done[m.Name] = true
+		}
+
+		batches = append(batches, batch)
+	}
+
+	return batches, nil
+}
+
+// failedDependency reports the first of m's depends_on entries present in
+// failed, if any. resolveManifestOrder's waves are computed once up front
+// from the full dependency graph, so with --continue-on-error a later wave
+// can still contain machines whose dependencies failed in an earlier wave;
+// this lets cmdCreateFromManifest skip them instead of creating them anyway.
+func failedDependency(m manifestMachine, failed map[string]error) (string, bool) {
+	for _, dep := range m.DependsOn {
+		if _, ok := failed[dep]; ok {
+			return dep, true
+		}
+	}
+	return "", false
+}
+
+// runManifestBatch creates every machine in batch concurrently, bounded by
+// manifestConcurrency, and returns the per-machine error (nil on success).
+func runManifestBatch(batch []manifestMachine, api libmachine.API) map[string]error {
+	results := map[string]error{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, manifestConcurrency)
+
+	for _, mm := range batch {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(mm manifestMachine) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := cmdCreateInner(newManifestCommandLine(mm), api)
+
+			mu.Lock()
+			results[mm.Name] = err
+			mu.Unlock()
+		}(mm)
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// writeResumeManifest writes out a manifest containing only the entries of
+// all that were not in created, so a partially-failed run can be resumed.
+func writeResumeManifest(path string, all []manifestMachine, created []string) error {
+	createdSet := map[string]bool{}
+	for _, name := range created {
+		createdSet[name] = true
+	}
+
+	var remaining manifest
+	for _, m := range all {
+		if !createdSet[m.Name] {
+			remaining.Machines = append(remaining.Machines, m)
+		}
+	}
+
+	out, err := yaml.Marshal(remaining)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, out, 0644)
+}
+
+// manifestCommandLine adapts a single manifest entry to the CommandLine
+// interface so cmdCreateInner's existing create pipeline can be reused
+// unchanged for manifest-driven creates. Values keeps whatever type the YAML
+// decoded (bool, int, string, float64 or a slice of any of those), so Bool,
+// Int and Generic can report real values instead of always reporting the
+// zero value the way a map[string]string forces them to.
+type manifestCommandLine struct {
+	machine manifestMachine
+	values  map[string]interface{}
+}
+
+func newManifestCommandLine(mm manifestMachine) *manifestCommandLine {
+	values := map[string]interface{}{
+		"driver":                mm.Driver,
+		"custom-install-script": mm.CustomInstallScript,
+		"tls-san":               mm.TLSSan,
+	}
+	for k, v := range mm.DriverOpts {
+		values[k] = v
+	}
+	for k, v := range mm.EngineOpts {
+		values["engine-"+k] = v
+	}
+	for k, v := range mm.SwarmOpts {
+		values["swarm-"+k] = v
+	}
+
+	return &manifestCommandLine{
+		machine: mm,
+		values:  values,
+	}
+}
+
+func (m *manifestCommandLine) ShowHelp()             {}
+func (m *manifestCommandLine) ShowVersion()          {}
+func (m *manifestCommandLine) Application() *cli.App { return cli.NewApp() }
+func (m *manifestCommandLine) Args() cli.Args        { return cli.Args([]string{m.machine.Name}) }
+
+func (m *manifestCommandLine) IsSet(name string) bool {
+	_, ok := m.values[name]
+	return ok
+}
+
+func (m *manifestCommandLine) Bool(name string) bool {
+	switch v := m.values[name].(type) {
+	case bool:
+		return v
+	case string:
+		b, _ := strconv.ParseBool(v)
+		return b
+	default:
+		return false
+	}
+}
+
+func (m *manifestCommandLine) BoolT(name string) bool { return true }
+
+func (m *manifestCommandLine) Int(name string) int {
+	switch v := m.values[name].(type) {
+	case int:
+		return v
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	case string:
+		i, _ := strconv.Atoi(v)
+		return i
+	default:
+		return 0
+	}
+}
+
+func (m *manifestCommandLine) String(name string) string {
+	switch v := m.values[name].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// StringSlice returns name's value as a []string, converting each element of
+// a YAML list (decoded as []interface{}) to its string form. It's the path
+// engine-opt/engine-label/engine-env/swarm-opt/swarm-join-opt take, since
+// those are StringSliceFlags and Generic can't represent them (see Generic).
+func (m *manifestCommandLine) StringSlice(name string) []string {
+	switch v := m.values[name].(type) {
+	case []string:
+		return v
+	case []interface{}:
+		out := make([]string, len(v))
+		for i, item := range v {
+			out[i] = fmt.Sprintf("%v", item)
+		}
+		return out
+	default:
+		return nil
+	}
+}
+
+func (m *manifestCommandLine) GlobalString(name string) string { return "" }
+
+// Generic returns a flag.Getter wrapping name's value, mirroring what a real
+// cli.Context.Generic(name) returns for String/Bool/Int flags. It returns nil
+// for slice-typed values, same as the TODO in getDriverOpts notes real
+// StringSliceFlags do: their underlying value doesn't implement flag.Getter,
+// so callers are expected to fall back to StringSlice instead.
+func (m *manifestCommandLine) Generic(name string) interface{} {
+	switch m.values[name].(type) {
+	case []string, []interface{}:
+		return nil
+	}
+
+	v, ok := m.values[name]
+	if !ok {
+		return nil
+	}
+
+	return &manifestGetter{value: v}
+}
+
+func (m *manifestCommandLine) FlagNames() []string {
+	names := make([]string, 0, len(m.values))
+	for name := range m.values {
+		names = append(names, name)
+	}
+	return names
+}
+
+// manifestGetter implements flag.Getter over a single value decoded from a
+// manifest entry, so manifestCommandLine.Generic can hand getDriverOpts
+// something it can call Get() on, the same as the stdlib flag.Getter that a
+// real cli.Context.Generic(name) returns for non-slice flags.
+type manifestGetter struct {
+	value interface{}
+}
+
+func (g *manifestGetter) String() string {
+	return fmt.Sprintf("%v", g.value)
+}
+
+func (g *manifestGetter) Set(s string) error {
+	g.value = s
+	return nil
+}
+
+func (g *manifestGetter) Get() interface{} {
+	return g.value
+}
+
+var _ flag.Getter = &manifestGetter{}
@@ -0,0 +1,82 @@
+package commands
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestResolveManifestOrder(t *testing.T) {
+	machines := []manifestMachine{
+		{Name: "db"},
+		{Name: "web", DependsOn: []string{"db"}},
+		{Name: "cache"},
+		{Name: "worker", DependsOn: []string{"web", "cache"}},
+	}
+
+	batches, err := resolveManifestOrder(machines)
+	if err != nil {
+		t.Fatalf("resolveManifestOrder: unexpected error: %v", err)
+	}
+
+	if len(batches) != 3 {
+		t.Fatalf("resolveManifestOrder() returned %d waves, want 3: %v", len(batches), batches)
+	}
+
+	wave := func(i int) map[string]bool {
+		names := map[string]bool{}
+		for _, mm := range batches[i] {
+			names[mm.Name] = true
+		}
+		return names
+	}
+
+	if w := wave(0); !w["db"] || !w["cache"] || len(w) != 2 {
+		t.Errorf("wave 0 = %v, want {db, cache}", w)
+	}
+	if w := wave(1); !w["web"] || len(w) != 1 {
+		t.Errorf("wave 1 = %v, want {web}", w)
+	}
+	if w := wave(2); !w["worker"] || len(w) != 1 {
+		t.Errorf("wave 2 = %v, want {worker}", w)
+	}
+}
+
+func TestResolveManifestOrderUnknownDependency(t *testing.T) {
+	machines := []manifestMachine{
+		{Name: "web", DependsOn: []string{"db"}},
+	}
+
+	if _, err := resolveManifestOrder(machines); err == nil {
+		t.Fatal("expected an error for an unknown depends_on target, got nil")
+	}
+}
+
+func TestResolveManifestOrderCycle(t *testing.T) {
+	machines := []manifestMachine{
+		{Name: "a", DependsOn: []string{"b"}},
+		{Name: "b", DependsOn: []string{"a"}},
+	}
+
+	if _, err := resolveManifestOrder(machines); err == nil {
+		t.Fatal("expected an error for a depends_on cycle, got nil")
+	}
+}
+
+func TestFailedDependency(t *testing.T) {
+	failed := map[string]error{"manager": fmt.Errorf("boom")}
+
+	worker := manifestMachine{Name: "worker", DependsOn: []string{"manager"}}
+	if dep, ok := failedDependency(worker, failed); !ok || dep != "manager" {
+		t.Errorf("failedDependency(worker) = (%q, %v), want (\"manager\", true)", dep, ok)
+	}
+
+	standalone := manifestMachine{Name: "standalone"}
+	if _, ok := failedDependency(standalone, failed); ok {
+		t.Error("failedDependency(standalone) = true, want false: no depends_on at all")
+	}
+
+	onlyHealthy := manifestMachine{Name: "cache", DependsOn: []string{"db"}}
+	if _, ok := failedDependency(onlyHealthy, failed); ok {
+		t.Error("failedDependency(cache) = true, want false: its dependency is not in failed")
+	}
+}
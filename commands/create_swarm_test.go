@@ -0,0 +1,58 @@
+package commands
+
+import (
+	"testing"
+
+	"github.com/rancher/machine/libmachine/swarm"
+)
+
+func TestDecideSwarmModeActionExplicitJoinToken(t *testing.T) {
+	mode := swarm.Mode{JoinToken: "explicit-token"}
+
+	// An explicit join token wins regardless of mode.Manager or whether a
+	// manager was discoverable.
+	for _, managerDiscovered := range []bool{true, false} {
+		if got := decideSwarmModeAction(mode, managerDiscovered); got != swarmModeActionJoinExplicit {
+			t.Errorf("decideSwarmModeAction(JoinToken set, discovered=%v) = %v, want swarmModeActionJoinExplicit", managerDiscovered, got)
+		}
+	}
+
+	managerMode := swarm.Mode{JoinToken: "explicit-token", Manager: true}
+	if got := decideSwarmModeAction(managerMode, true); got != swarmModeActionJoinExplicit {
+		t.Errorf("decideSwarmModeAction(JoinToken set, Manager=true) = %v, want swarmModeActionJoinExplicit", got)
+	}
+}
+
+func TestDecideSwarmModeActionFirstManagerInits(t *testing.T) {
+	mode := swarm.Mode{Manager: true}
+
+	if got := decideSwarmModeAction(mode, false); got != swarmModeActionInit {
+		t.Errorf("decideSwarmModeAction(Manager, no manager discovered) = %v, want swarmModeActionInit", got)
+	}
+}
+
+func TestDecideSwarmModeActionSecondManagerJoins(t *testing.T) {
+	mode := swarm.Mode{Manager: true}
+
+	// A manager already exists: this must join it, not init a second
+	// disjoint cluster (the chunk0-1 bug this function exists to fix).
+	if got := decideSwarmModeAction(mode, true); got != swarmModeActionJoinManager {
+		t.Errorf("decideSwarmModeAction(Manager, manager discovered) = %v, want swarmModeActionJoinManager", got)
+	}
+}
+
+func TestDecideSwarmModeActionWorkerJoins(t *testing.T) {
+	mode := swarm.Mode{}
+
+	if got := decideSwarmModeAction(mode, true); got != swarmModeActionJoinWorker {
+		t.Errorf("decideSwarmModeAction(worker, manager discovered) = %v, want swarmModeActionJoinWorker", got)
+	}
+}
+
+func TestDecideSwarmModeActionWorkerWithNoManagerErrors(t *testing.T) {
+	mode := swarm.Mode{}
+
+	if got := decideSwarmModeAction(mode, false); got != swarmModeActionErrNoManager {
+		t.Errorf("decideSwarmModeAction(worker, no manager discovered) = %v, want swarmModeActionErrNoManager", got)
+	}
+}
@@ -0,0 +1,30 @@
+package commands
+
+import "testing"
+
+func TestRenderUserdataTemplate(t *testing.T) {
+	ctx := userdataTemplateContext{
+		MachineName: "my-machine",
+		DriverName:  "virtualbox",
+		IP:          "",
+		SSHUser:     "docker",
+		TLSSan:      []string{"example.com"},
+		Vars:        map[string]string{"env": "staging"},
+	}
+
+	out, err := renderUserdataTemplate([]byte("#!/bin/sh\n# {{.MachineName}} ({{.DriverName}}) env={{.Vars.env}}\n"), ctx)
+	if err != nil {
+		t.Fatalf("renderUserdataTemplate: unexpected error: %v", err)
+	}
+
+	want := "#!/bin/sh\n# my-machine (virtualbox) env=staging\n"
+	if string(out) != want {
+		t.Errorf("renderUserdataTemplate() = %q, want %q", out, want)
+	}
+}
+
+func TestRenderUserdataTemplateInvalid(t *testing.T) {
+	if _, err := renderUserdataTemplate([]byte("{{.Nope"), userdataTemplateContext{}); err == nil {
+		t.Fatal("expected an error for an unparseable template, got nil")
+	}
+}
@@ -0,0 +1,70 @@
+package provision
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rancher/machine/libmachine/swarm"
+)
+
+// sshCommander is the minimal surface needed to drive the docker CLI over
+// SSH while configuring native Swarm-mode; host.Host satisfies it.
+type sshCommander interface {
+	RunSSHCommand(string) (string, error)
+}
+
+// SwarmModeInit runs `docker swarm init` on the first manager of a native
+// Swarm-mode cluster and returns the manager and worker join tokens so they
+// can be persisted back into the machine store.
+func SwarmModeInit(h sshCommander, mode swarm.Mode) (managerToken, workerToken string, err error) {
+	cmd := "docker swarm init"
+	if mode.AdvertiseAddr != "" {
+		cmd += fmt.Sprintf(" --advertise-addr %s", mode.AdvertiseAddr)
+	}
+	if mode.ListenAddr != "" {
+		cmd += fmt.Sprintf(" --listen-addr %s", mode.ListenAddr)
+	}
+
+	if _, err := h.RunSSHCommand(cmd); err != nil {
+		return "", "", fmt.Errorf("Error running docker swarm init: %s", err)
+	}
+
+	managerToken, err = swarmModeJoinToken(h, "manager")
+	if err != nil {
+		return "", "", err
+	}
+
+	workerToken, err = swarmModeJoinToken(h, "worker")
+	if err != nil {
+		return "", "", err
+	}
+
+	return managerToken, workerToken, nil
+}
+
+// SwarmModeJoin runs `docker swarm join` against a discovered manager so
+// this host joins an existing native Swarm-mode cluster.
+func SwarmModeJoin(h sshCommander, managerAddr, joinToken string, mode swarm.Mode) error {
+	cmd := fmt.Sprintf("docker swarm join --token %s %s", joinToken, managerAddr)
+	if mode.AdvertiseAddr != "" {
+		cmd += fmt.Sprintf(" --advertise-addr %s", mode.AdvertiseAddr)
+	}
+	if mode.ListenAddr != "" {
+		cmd += fmt.Sprintf(" --listen-addr %s", mode.ListenAddr)
+	}
+
+	if _, err := h.RunSSHCommand(cmd); err != nil {
+		return fmt.Errorf("Error running docker swarm join: %s", err)
+	}
+
+	return nil
+}
+
+func swarmModeJoinToken(h sshCommander, role string) (string, error) {
+	out, err := h.RunSSHCommand(fmt.Sprintf("docker swarm join-token -q %s", role))
+	if err != nil {
+		return "", fmt.Errorf("Error fetching swarm %s join token: %s", role, err)
+	}
+
+	return strings.TrimSpace(out), nil
+}
@@ -0,0 +1,31 @@
+package swarm
+
+// Mode holds the native Docker Swarm-mode (swarmkit) configuration for a
+// machine, as an alternative to the legacy classic Swarm fields on Options.
+type Mode struct {
+	// Enabled turns on native Swarm-mode for this machine.
+	Enabled bool
+
+	// Manager marks this machine as a Swarm-mode manager. The first
+	// manager created runs `docker swarm init`; subsequent managers and
+	// workers join an existing cluster.
+	Manager bool
+
+	// JoinToken is the token used to join an existing cluster. It is
+	// left empty on the first manager, which generates its own tokens.
+	JoinToken string
+
+	// AdvertiseAddr is the address advertised to other members of the
+	// cluster, passed to `docker swarm init`/`docker swarm join`.
+	AdvertiseAddr string
+
+	// ListenAddr is the address Swarm-mode listens on for cluster
+	// management traffic.
+	ListenAddr string
+
+	// ManagerToken and WorkerToken are captured from `docker swarm init`
+	// on the first manager so that later machines can join without
+	// re-deriving them.
+	ManagerToken string
+	WorkerToken  string
+}
@@ -0,0 +1,22 @@
+package swarm
+
+// Options stores the configuration of the Swarm instance, if any, that will
+// be configured on top of the machine's Docker Engine.
+type Options struct {
+	IsSwarm            bool
+	Address            string
+	Discovery          string
+	Agent              bool
+	Master             bool
+	Host               string
+	Image              string
+	Strategy           string
+	ArbitraryFlags     []string
+	ArbitraryJoinFlags []string
+	IsExperimental     bool
+
+	// Mode holds the configuration for native Docker Swarm-mode
+	// (swarmkit) clustering, used alongside (or instead of) the legacy
+	// classic Swarm options above.
+	Mode Mode
+}
@@ -0,0 +1,90 @@
+package userdata
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ButaneFormatter handles Butane YAML, the human-friendly source format
+// that transpiles to Ignition. Merge adds the custom-install-script as a
+// storage.files entry the same way IgnitionFormatter does; Transpile then
+// shells out to the `butane` CLI to produce the Ignition JSON the driver
+// actually uploads, so the butane binary must be on PATH at create time.
+type ButaneFormatter struct{}
+
+// Name implements Formatter.
+func (f *ButaneFormatter) Name() string { return "butane" }
+
+// Detect implements Formatter.
+func (f *ButaneFormatter) Detect(content []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(content), []byte("variant:"))
+}
+
+// Merge implements Formatter.
+func (f *ButaneFormatter) Merge(userdataContent, installScriptContent []byte) ([]byte, error) {
+	doc := map[string]interface{}{}
+	if len(bytes.TrimSpace(userdataContent)) > 0 {
+		if err := yaml.Unmarshal(userdataContent, &doc); err != nil {
+			return nil, fmt.Errorf("invalid butane userdata: %v", err)
+		}
+	}
+	if _, ok := doc["variant"]; !ok {
+		doc["variant"] = "fcos"
+		doc["version"] = "1.5.0"
+	}
+
+	storage, _ := doc["storage"].(map[interface{}]interface{})
+	if storage == nil {
+		storage = map[interface{}]interface{}{}
+	}
+	files, _ := storage["files"].([]interface{})
+	files = append(files, map[string]interface{}{
+		"path": "/usr/local/custom_script/install.sh",
+		"mode": 0755,
+		"contents": map[string]interface{}{
+			"inline": string(installScriptContent),
+		},
+	})
+	storage["files"] = files
+	doc["storage"] = storage
+
+	systemd, _ := doc["systemd"].(map[interface{}]interface{})
+	if systemd == nil {
+		systemd = map[interface{}]interface{}{}
+	}
+	units, _ := systemd["units"].([]interface{})
+	units = append(units, map[string]interface{}{
+		"name":    "custom-install-script.service",
+		"enabled": true,
+		// Invoked via "/bin/sh <path>" rather than executed directly: the
+		// install script arrives with its shebang stripped (create.go's
+		// updateUserdataFile strips it before the format is known), so systemd exec'ing
+		// it directly would fail with ENOEXEC.
+		"contents": "[Unit]\nDescription=custom-install-script\n[Service]\nType=oneshot\nExecStart=/bin/sh /usr/local/custom_script/install.sh\n[Install]\nWantedBy=multi-user.target\n",
+	})
+	systemd["units"] = units
+	doc["systemd"] = systemd
+
+	return yaml.Marshal(doc)
+}
+
+// Transpile converts merged Butane YAML into Ignition JSON by shelling out
+// to the `butane` CLI.
+func (f *ButaneFormatter) Transpile(butaneContent []byte) ([]byte, error) {
+	cmd := exec.Command("butane", "--strict")
+	cmd.Stdin = bytes.NewReader(butaneContent)
+
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("error transpiling butane userdata to ignition: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return out.Bytes(), nil
+}
@@ -0,0 +1,92 @@
+package userdata
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// CloudConfigFormatter handles #cloud-config userdata. The
+// custom-install-script is gzip+b64 encoded into a write_files entry and
+// run via a matching bootcmd entry, so it executes on every boot rather
+// than only the first (runcmd only ever fires once, on initial boot).
+type CloudConfigFormatter struct{}
+
+// Name implements Formatter.
+func (f *CloudConfigFormatter) Name() string { return "cloud-config" }
+
+// Detect implements Formatter.
+func (f *CloudConfigFormatter) Detect(content []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(content), []byte("#cloud-config"))
+}
+
+// Merge implements Formatter.
+func (f *CloudConfigFormatter) Merge(userdataContent, installScriptContent []byte) ([]byte, error) {
+	cf := make(map[interface{}]interface{})
+	if len(bytes.TrimSpace(userdataContent)) > 0 {
+		if err := yaml.Unmarshal(userdataContent, &cf); err != nil {
+			return nil, err
+		}
+	}
+
+	return f.mergeGzippedScript(cf, installScriptContent)
+}
+
+// mergeGzippedScript writes installScriptContent as a gzip+b64 write_files
+// entry and adds a matching bootcmd entry onto cf.
+func (f *CloudConfigFormatter) mergeGzippedScript(cf map[interface{}]interface{}, installScriptContent []byte) ([]byte, error) {
+	encoded, err := gzipEncode(installScriptContent)
+	if err != nil {
+		return nil, err
+	}
+
+	writeFile := map[string]string{
+		"encoding":    "gzip+b64",
+		"content":     encoded,
+		"path":        "/usr/local/custom_script/install.sh",
+		"permissions": "0644",
+	}
+	if err := addToCloudConfig(cf, "write_files", writeFile); err != nil {
+		return nil, err
+	}
+	if err := addToCloudConfig(cf, "bootcmd", fmt.Sprintf("sh %s", writeFile["path"])); err != nil {
+		return nil, err
+	}
+
+	content, err := yaml.Marshal(cf)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte("#cloud-config\n"), content...), nil
+}
+
+func addToCloudConfig(cf map[interface{}]interface{}, key string, value interface{}) error {
+	switch section := cf[key].(type) {
+	case []interface{}:
+		cf[key] = append(section, value)
+
+	case nil:
+		cf[key] = []interface{}{value}
+
+	default:
+		return fmt.Errorf("unable to get %s from cloud-config YAML", key)
+	}
+
+	return nil
+}
+
+func gzipEncode(data []byte) (string, error) {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	if _, err := gz.Write(data); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+
+	return base64Encode(b.Bytes()), nil
+}
@@ -0,0 +1,68 @@
+package userdata
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// IgnitionFormatter handles Fedora CoreOS / Flatcar Ignition userdata,
+// recognized by its JSON object format. The custom-install-script is merged
+// in as a `storage.files` entry run by a `systemd.units` oneshot unit,
+// rather than a cloud-config write_files/bootcmd pair.
+type IgnitionFormatter struct{}
+
+// Name implements Formatter.
+func (f *IgnitionFormatter) Name() string { return "ignition" }
+
+// Detect implements Formatter.
+func (f *IgnitionFormatter) Detect(content []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(content), []byte("{"))
+}
+
+// Merge implements Formatter.
+func (f *IgnitionFormatter) Merge(userdataContent, installScriptContent []byte) ([]byte, error) {
+	doc := map[string]interface{}{}
+	if len(bytes.TrimSpace(userdataContent)) > 0 {
+		if err := json.Unmarshal(userdataContent, &doc); err != nil {
+			return nil, fmt.Errorf("invalid ignition userdata: %v", err)
+		}
+	}
+	if _, ok := doc["ignition"]; !ok {
+		doc["ignition"] = map[string]interface{}{"version": "3.3.0"}
+	}
+
+	storage, _ := doc["storage"].(map[string]interface{})
+	if storage == nil {
+		storage = map[string]interface{}{}
+	}
+	files, _ := storage["files"].([]interface{})
+	files = append(files, map[string]interface{}{
+		"path": "/usr/local/custom_script/install.sh",
+		"mode": 0755,
+		"contents": map[string]interface{}{
+			"source": "data:text/plain;base64," + base64Encode(installScriptContent),
+		},
+	})
+	storage["files"] = files
+	doc["storage"] = storage
+
+	systemd, _ := doc["systemd"].(map[string]interface{})
+	if systemd == nil {
+		systemd = map[string]interface{}{}
+	}
+	units, _ := systemd["units"].([]interface{})
+	units = append(units, map[string]interface{}{
+		"name":     "custom-install-script.service",
+		"enabled":  true,
+		// Invoked via "/bin/sh <path>" rather than executed directly: the
+		// install script arrives with its shebang stripped (create.go's
+		// updateUserdataFile strips it before the format is known), so systemd exec'ing
+		// it directly would fail with ENOEXEC.
+		"contents": "[Unit]\nDescription=custom-install-script\n[Service]\nType=oneshot\nExecStart=/bin/sh /usr/local/custom_script/install.sh\n[Install]\nWantedBy=multi-user.target\n",
+	})
+	systemd["units"] = units
+	doc["systemd"] = systemd
+
+	return json.MarshalIndent(doc, "", "  ")
+}
@@ -0,0 +1,33 @@
+package userdata
+
+import (
+	"bytes"
+	"regexp"
+)
+
+// ShellFormatter handles plain shell-script userdata (files beginning with
+// a "#!" shebang). Merging converts the result to cloud-config so that it
+// can carry both the original script and the custom-install-script in a
+// single ordered bootcmd.
+type ShellFormatter struct{}
+
+// Name implements Formatter.
+func (f *ShellFormatter) Name() string { return "shell" }
+
+// Detect implements Formatter.
+func (f *ShellFormatter) Detect(content []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(content), []byte("#!"))
+}
+
+// Merge implements Formatter.
+func (f *ShellFormatter) Merge(userdataContent, installScriptContent []byte) ([]byte, error) {
+	userdataContent = stripShebang(userdataContent)
+	combined := bytes.Join([][]byte{userdataContent, installScriptContent}, []byte("\n\n"))
+
+	cc := &CloudConfigFormatter{}
+	return cc.mergeGzippedScript(map[interface{}]interface{}{}, combined)
+}
+
+func stripShebang(content []byte) []byte {
+	return regexp.MustCompile(`^#!.*\n`).ReplaceAll(content, nil)
+}
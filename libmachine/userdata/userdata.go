@@ -0,0 +1,60 @@
+// Package userdata implements pluggable formatters that merge a
+// custom-install-script into a machine's userdata, regardless of which
+// cloud-init-like format that userdata happens to be written in.
+package userdata
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+)
+
+// Formatter knows how to recognize its own userdata format from a file's
+// magic prefix, and how to merge a custom-install-script into userdata
+// written in that format.
+type Formatter interface {
+	// Name identifies the format for use with --userdata-format.
+	Name() string
+
+	// Detect reports whether content looks like this format.
+	Detect(content []byte) bool
+
+	// Merge combines an install script into userdata content, returning
+	// the bytes that should be written out as the new userdata file.
+	Merge(userdataContent, installScriptContent []byte) ([]byte, error)
+}
+
+var formatters = []Formatter{
+	&ShellFormatter{},
+	&CloudConfigFormatter{},
+	&IgnitionFormatter{},
+	&ButaneFormatter{},
+}
+
+// ByName returns the formatter registered under name, e.g. "shell",
+// "cloud-config", "ignition" or "butane".
+func ByName(name string) (Formatter, error) {
+	for _, f := range formatters {
+		if f.Name() == name {
+			return f, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unrecognized userdata format: %s", name)
+}
+
+// Detect returns the formatter that recognizes content's magic prefix, or
+// an error if none do.
+func Detect(content []byte) (Formatter, error) {
+	for _, f := range formatters {
+		if f.Detect(content) {
+			return f, nil
+		}
+	}
+
+	return nil, fmt.Errorf("could not detect userdata format from content: %q", bytes.TrimSpace(content))
+}
+
+func base64Encode(data []byte) string {
+	return base64.StdEncoding.EncodeToString(data)
+}
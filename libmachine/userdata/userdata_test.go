@@ -0,0 +1,121 @@
+package userdata
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	cases := []struct {
+		content []byte
+		want    string
+	}{
+		{[]byte("#!/bin/sh\necho hi\n"), "shell"},
+		{[]byte("#cloud-config\npackages: [curl]\n"), "cloud-config"},
+		{[]byte(`{"ignition": {"version": "3.3.0"}}`), "ignition"},
+		{[]byte("variant: fcos\nversion: 1.5.0\n"), "butane"},
+	}
+
+	for _, c := range cases {
+		f, err := Detect(c.content)
+		if err != nil {
+			t.Fatalf("Detect(%q): unexpected error: %v", c.content, err)
+		}
+		if f.Name() != c.want {
+			t.Errorf("Detect(%q) = %q, want %q", c.content, f.Name(), c.want)
+		}
+	}
+}
+
+func TestDetectUnrecognized(t *testing.T) {
+	if _, err := Detect([]byte("not a recognized format")); err == nil {
+		t.Fatal("expected an error for unrecognized content, got nil")
+	}
+}
+
+func TestByName(t *testing.T) {
+	for _, name := range []string{"shell", "cloud-config", "ignition", "butane"} {
+		f, err := ByName(name)
+		if err != nil {
+			t.Fatalf("ByName(%q): unexpected error: %v", name, err)
+		}
+		if f.Name() != name {
+			t.Errorf("ByName(%q).Name() = %q", name, f.Name())
+		}
+	}
+
+	if _, err := ByName("bogus"); err == nil {
+		t.Fatal("expected an error for an unrecognized format name, got nil")
+	}
+}
+
+func TestShellFormatterMerge(t *testing.T) {
+	merged, err := (&ShellFormatter{}).Merge([]byte("#!/bin/sh\necho hello\n"), []byte("echo install"))
+	if err != nil {
+		t.Fatalf("Merge: unexpected error: %v", err)
+	}
+
+	if !strings.HasPrefix(string(merged), "#cloud-config") {
+		t.Fatalf("Merge result does not start with #cloud-config: %s", merged)
+	}
+	if !strings.Contains(string(merged), "write_files") || !strings.Contains(string(merged), "bootcmd") {
+		t.Fatalf("Merge result missing write_files/bootcmd: %s", merged)
+	}
+}
+
+func TestCloudConfigFormatterMerge(t *testing.T) {
+	merged, err := (&CloudConfigFormatter{}).Merge([]byte("#cloud-config\npackages: [curl]\n"), []byte("echo install"))
+	if err != nil {
+		t.Fatalf("Merge: unexpected error: %v", err)
+	}
+
+	out := string(merged)
+	if !strings.HasPrefix(out, "#cloud-config") {
+		t.Fatalf("Merge result does not start with #cloud-config: %s", out)
+	}
+	if !strings.Contains(out, "curl") {
+		t.Fatalf("Merge result dropped existing cloud-config content: %s", out)
+	}
+	if !strings.Contains(out, "write_files") || !strings.Contains(out, "bootcmd") {
+		t.Fatalf("Merge result missing write_files/bootcmd: %s", out)
+	}
+}
+
+func TestIgnitionFormatterMerge(t *testing.T) {
+	merged, err := (&IgnitionFormatter{}).Merge([]byte("{}"), []byte("echo install"))
+	if err != nil {
+		t.Fatalf("Merge: unexpected error: %v", err)
+	}
+
+	out := string(merged)
+	if !strings.Contains(out, "\"storage\"") || !strings.Contains(out, "\"systemd\"") {
+		t.Fatalf("Merge result missing storage/systemd sections: %s", out)
+	}
+	if !strings.Contains(out, "custom-install-script.service") {
+		t.Fatalf("Merge result missing the custom-install-script unit: %s", out)
+	}
+	if !strings.Contains(out, "/bin/sh /usr/local/custom_script/install.sh") {
+		t.Fatalf("Merge result does not invoke install.sh via sh: %s", out)
+	}
+}
+
+func TestButaneFormatterMerge(t *testing.T) {
+	merged, err := (&ButaneFormatter{}).Merge([]byte("variant: fcos\nversion: 1.5.0\n"), []byte("echo install"))
+	if err != nil {
+		t.Fatalf("Merge: unexpected error: %v", err)
+	}
+
+	out := string(merged)
+	if !strings.Contains(out, "storage") {
+		t.Fatalf("Merge result missing storage section: %s", out)
+	}
+	if !strings.Contains(out, "install.sh") {
+		t.Fatalf("Merge result missing the custom-install-script file: %s", out)
+	}
+	if !strings.Contains(out, "systemd") || !strings.Contains(out, "custom-install-script.service") {
+		t.Fatalf("Merge result missing the custom-install-script systemd unit: %s", out)
+	}
+	if !strings.Contains(out, "/bin/sh /usr/local/custom_script/install.sh") {
+		t.Fatalf("Merge result does not invoke install.sh via sh: %s", out)
+	}
+}